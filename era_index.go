@@ -0,0 +1,276 @@
+package sftools
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/streamingfast/dstore"
+)
+
+// eraIndexMagic/eraIndexVersion identify the sidecar format written
+// alongside a merged-blocks bundle.
+const (
+	eraIndexMagic   = "SFEI" // StreamingFast Era Index
+	eraIndexVersion = uint8(1)
+)
+
+// blockHashRecord is one row of a sidecar's block table: where a block's
+// serialized bytes live within the bundle, and their hash.
+type blockHashRecord struct {
+	blockNum uint64
+	blockID  string
+	offset   uint64
+	length   uint64
+	sum      []byte
+}
+
+// eraIndex is the decoded form of a sidecar file.
+type eraIndex struct {
+	protocolID  uint32
+	lowBlockNum uint64
+	records     []blockHashRecord
+	root        []byte
+}
+
+// newEraIndex serializes the header, per-block hash table, and Merkle
+// accumulator root for a bundle into the sidecar's on-disk representation.
+func newEraIndex(lowBlockNum uint64, protocolID uint32, records []blockHashRecord, hashFn func() hash.Hash) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString(eraIndexMagic)
+	buf.WriteByte(eraIndexVersion)
+	writeUint32(buf, protocolID)
+	writeUint64(buf, lowBlockNum)
+	writeUint32(buf, uint32(len(records)))
+
+	leaves := make([][]byte, len(records))
+	for i, rec := range records {
+		writeUint64(buf, rec.blockNum)
+		writeString(buf, rec.blockID)
+		writeUint64(buf, rec.offset)
+		writeUint64(buf, rec.length)
+		writeBytes(buf, rec.sum)
+		leaves[i] = rec.sum
+	}
+
+	writeBytes(buf, merkleRoot(hashFn, leaves))
+
+	return buf.Bytes()
+}
+
+func decodeEraIndex(data []byte) (*eraIndex, error) {
+	r := bytes.NewReader(data)
+
+	magic := make([]byte, len(eraIndexMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != eraIndexMagic {
+		return nil, fmt.Errorf("not a valid era index (bad magic)")
+	}
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("reading version: %w", err)
+	}
+	if version != eraIndexVersion {
+		return nil, fmt.Errorf("unsupported era index version %d", version)
+	}
+
+	protocolID, err := readUint32(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading protocol id: %w", err)
+	}
+
+	lowBlockNum, err := readUint64(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading low block num: %w", err)
+	}
+
+	count, err := readUint32(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading record count: %w", err)
+	}
+
+	records := make([]blockHashRecord, count)
+	for i := range records {
+		blockNum, err := readUint64(r)
+		if err != nil {
+			return nil, fmt.Errorf("reading record %d block num: %w", i, err)
+		}
+		blockID, err := readString(r)
+		if err != nil {
+			return nil, fmt.Errorf("reading record %d block id: %w", i, err)
+		}
+		offset, err := readUint64(r)
+		if err != nil {
+			return nil, fmt.Errorf("reading record %d offset: %w", i, err)
+		}
+		length, err := readUint64(r)
+		if err != nil {
+			return nil, fmt.Errorf("reading record %d length: %w", i, err)
+		}
+		sum, err := readBytes(r)
+		if err != nil {
+			return nil, fmt.Errorf("reading record %d hash: %w", i, err)
+		}
+		records[i] = blockHashRecord{blockNum: blockNum, blockID: blockID, offset: offset, length: length, sum: sum}
+	}
+
+	root, err := readBytes(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading accumulator root: %w", err)
+	}
+
+	return &eraIndex{protocolID: protocolID, lowBlockNum: lowBlockNum, records: records, root: root}, nil
+}
+
+// merkleRoot computes a binary Merkle accumulator root over leaves,
+// duplicating the last node whenever a level has an odd number of nodes.
+func merkleRoot(hashFn func() hash.Hash, leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return nil
+	}
+
+	level := leaves
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			h := hashFn()
+			h.Write(level[i])
+			if i+1 < len(level) {
+				h.Write(level[i+1])
+			} else {
+				h.Write(level[i]) // duplicate the last node on an odd level
+			}
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+
+	return level[0]
+}
+
+// VerifyBundle re-derives every block's hash and the Merkle accumulator
+// root from a bundle's sidecar index and raw bytes, and returns an error
+// describing the first mismatch found.
+//
+// uuid must match whatever WithContentAddressedNaming produced for this
+// bundle: pass the empty string for a writer that has it disabled, or the
+// bundle's UUID (as recorded in the manifest) otherwise.
+func VerifyBundle(ctx context.Context, store dstore.Store, hashFn func() hash.Hash, lowBlockNum uint64, uuid string) error {
+	file := bundleObjectName(lowBlockNum, uuid)
+
+	bundleBytes, err := readObject(ctx, store, file)
+	if err != nil {
+		return fmt.Errorf("reading bundle %s: %w", file, err)
+	}
+
+	idxBytes, err := readObject(ctx, store, file+eraIndexSuffix)
+	if err != nil {
+		return fmt.Errorf("reading sidecar index for %s: %w", file, err)
+	}
+
+	idx, err := decodeEraIndex(idxBytes)
+	if err != nil {
+		return fmt.Errorf("decoding sidecar index for %s: %w", file, err)
+	}
+
+	if idx.lowBlockNum != lowBlockNum {
+		return fmt.Errorf("sidecar index for %s claims low block num %d, expected %d", file, idx.lowBlockNum, lowBlockNum)
+	}
+
+	leaves := make([][]byte, len(idx.records))
+	for i, rec := range idx.records {
+		if rec.offset+rec.length > uint64(len(bundleBytes)) {
+			return fmt.Errorf("record %d (block %d, %s) points past the end of bundle %s", i, rec.blockNum, rec.blockID, file)
+		}
+
+		h := hashFn()
+		h.Write(bundleBytes[rec.offset : rec.offset+rec.length])
+		sum := h.Sum(nil)
+		if !bytes.Equal(sum, rec.sum) {
+			return fmt.Errorf("hash mismatch for block %d (%s) in bundle %s", rec.blockNum, rec.blockID, file)
+		}
+		leaves[i] = rec.sum
+	}
+
+	root := merkleRoot(hashFn, leaves)
+	if !bytes.Equal(root, idx.root) {
+		return fmt.Errorf("merkle accumulator root mismatch for bundle %s", file)
+	}
+
+	return nil
+}
+
+func readObject(ctx context.Context, store dstore.Store, name string) ([]byte, error) {
+	obj, err := store.OpenObject(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	return io.ReadAll(obj)
+}
+
+const eraIndexSuffix = ".idx"
+
+func writeUint32(buf *bytes.Buffer, v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	buf.Write(b[:])
+}
+
+func writeUint64(buf *bytes.Buffer, v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	buf.Write(b[:])
+}
+
+func writeBytes(buf *bytes.Buffer, v []byte) {
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(v)))
+	buf.Write(l[:])
+	buf.Write(v)
+}
+
+func writeString(buf *bytes.Buffer, v string) {
+	writeBytes(buf, []byte(v))
+}
+
+func readUint32(r *bytes.Reader) (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+func readUint64(r *bytes.Reader) (uint64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint16(l[:])
+	v := make([]byte, n)
+	if _, err := io.ReadFull(r, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	v, err := readBytes(r)
+	if err != nil {
+		return "", err
+	}
+	return string(v), nil
+}
@@ -0,0 +1,92 @@
+package sftools
+
+import (
+	"context"
+	"crypto/sha256"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// TestVerifyBundle_RoundTrip writes a bundle with its sidecar index through
+// mergedBlocksWriter and checks that VerifyBundle accepts the result and
+// rejects it once either the bundle bytes or the sidecar have been
+// tampered with.
+func TestVerifyBundle_RoundTrip(t *testing.T) {
+	store := newFakeStore()
+	w := newMergedBlocksWriter(store, fakeBlockWriterFactory{}, 0, 0, zap.NewNop(),
+		WithBundleSize(4), WithFirstStreamableBlock(0), WithSidecarIndex())
+
+	for n := uint64(0); n <= 3; n++ {
+		if err := w.ProcessBlock(testBlock(n), nil); err != nil {
+			t.Fatalf("ProcessBlock(%d): %v", n, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if err := VerifyBundle(context.Background(), store, sha256.New, 0, ""); err != nil {
+		t.Fatalf("VerifyBundle on an untampered bundle: %v", err)
+	}
+
+	t.Run("corrupted bundle bytes", func(t *testing.T) {
+		corrupted := newFakeStore()
+		for name, data := range storeSnapshot(store) {
+			cp := append([]byte(nil), data...)
+			corrupted.files[name] = cp
+		}
+		bundle := corrupted.files[filename(0)]
+		bundle[0] ^= 0xff
+
+		err := VerifyBundle(context.Background(), corrupted, sha256.New, 0, "")
+		if err == nil || !strings.Contains(err.Error(), "hash mismatch") {
+			t.Fatalf("VerifyBundle on a corrupted bundle = %v, want a hash mismatch error", err)
+		}
+	})
+
+	t.Run("corrupted sidecar", func(t *testing.T) {
+		corrupted := newFakeStore()
+		for name, data := range storeSnapshot(store) {
+			cp := append([]byte(nil), data...)
+			corrupted.files[name] = cp
+		}
+		idx := corrupted.files[filename(0)+eraIndexSuffix]
+		idx[len(idx)-1] ^= 0xff
+
+		err := VerifyBundle(context.Background(), corrupted, sha256.New, 0, "")
+		if err == nil {
+			t.Fatalf("VerifyBundle on a corrupted sidecar = nil, want an error")
+		}
+	})
+
+	t.Run("odd block count", func(t *testing.T) {
+		odd := newFakeStore()
+		ow := newMergedBlocksWriter(odd, fakeBlockWriterFactory{}, 0, 0, zap.NewNop(),
+			WithBundleSize(3), WithFirstStreamableBlock(0), WithSidecarIndex())
+
+		for n := uint64(0); n <= 2; n++ {
+			if err := ow.ProcessBlock(testBlock(n), nil); err != nil {
+				t.Fatalf("ProcessBlock(%d): %v", n, err)
+			}
+		}
+		if err := ow.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+
+		if err := VerifyBundle(context.Background(), odd, sha256.New, 0, ""); err != nil {
+			t.Fatalf("VerifyBundle on a 3-block bundle (odd merkle level): %v", err)
+		}
+	})
+}
+
+func storeSnapshot(s *fakeStore) map[string][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string][]byte, len(s.files))
+	for name, data := range s.files {
+		out[name] = data
+	}
+	return out
+}
@@ -0,0 +1,118 @@
+package sftools
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// BundleManifestEntry records everything a reader needs to detect whether
+// two merger instances produced diverging bundles for the same block
+// range: the range itself, the content-addressed UUID of the bundle, and
+// the ordered block IDs that went into it.
+type BundleManifestEntry struct {
+	LowBlockNum  uint64    `json:"low_block_num"`
+	HighBlockNum uint64    `json:"high_block_num"`
+	UUID         string    `json:"uuid"`
+	BlockIDs     []string  `json:"block_ids"`
+	ProducedAt   time.Time `json:"produced_at"`
+}
+
+// bundleUUID deterministically derives a UUID-formatted identifier from a
+// bundle's ordered block IDs: a SHA-256 digest over their length-prefixed
+// concatenation, truncated to 16 bytes and stamped with the RFC 4122
+// version/variant bits of a name-based (v5) UUID so the result is
+// recognized by ordinary UUID tooling. Two producers that assembled the
+// same blocks in the same order always land on the same UUID; a
+// re-merge after a reorg, or a different fork, does not.
+func bundleUUID(blockIDs []string) string {
+	h := sha256.New()
+	var lenBuf [8]byte
+	for _, id := range blockIDs {
+		binary.BigEndian.PutUint64(lenBuf[:], uint64(len(id)))
+		h.Write(lenBuf[:])
+		h.Write([]byte(id))
+	}
+	sum := h.Sum(nil)
+
+	b := make([]byte, 16)
+	copy(b, sum[:16])
+	b[6] = (b[6] & 0x0f) | 0x50 // version 5 (name-based)
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// appendManifest records entry into the writer's rolling bundle manifest:
+// a newline-delimited JSON object in the same store, read back and
+// rewritten on every bundle since dstore.Store has no append primitive.
+//
+// The read-modify-write cycle is guarded by manifestMu, which only
+// protects against concurrent upload workers within this process; two
+// separate merger instances racing to append still clobber one another.
+// See WithBundleManifest.
+func (w *mergedBlocksWriter) appendManifest(entry *BundleManifestEntry) error {
+	w.manifestMu.Lock()
+	defer w.manifestMu.Unlock()
+
+	ctx := context.Background()
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("marshaling bundle manifest entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	var existing []byte
+	exists, err := w.store.FileExists(ctx, w.manifestFilename)
+	if err != nil {
+		return fmt.Errorf("checking for existing bundle manifest %s: %w", w.manifestFilename, err)
+	}
+	if exists {
+		existing, err = readObject(ctx, w.store, w.manifestFilename)
+		if err != nil {
+			return fmt.Errorf("reading existing bundle manifest %s: %w", w.manifestFilename, err)
+		}
+	}
+
+	if err := w.store.WriteObject(ctx, w.manifestFilename, bytes.NewReader(append(existing, line...))); err != nil {
+		return fmt.Errorf("writing bundle manifest %s: %w", w.manifestFilename, err)
+	}
+
+	return nil
+}
+
+// findManifestUUID looks up the most recently recorded UUID for
+// lowBlockNum in the writer's manifest. It's used by orphaned-bundle
+// recovery (see reorg.go) to locate a content-addressed bundle's object
+// name without otherwise tracking it once it's left w.pending.
+func (w *mergedBlocksWriter) findManifestUUID(lowBlockNum uint64) (string, error) {
+	data, err := readObject(context.Background(), w.store, w.manifestFilename)
+	if err != nil {
+		return "", fmt.Errorf("reading bundle manifest %s: %w", w.manifestFilename, err)
+	}
+
+	uuid := ""
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var entry BundleManifestEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return "", fmt.Errorf("decoding bundle manifest entry: %w", err)
+		}
+		if entry.LowBlockNum == lowBlockNum {
+			uuid = entry.UUID
+		}
+	}
+
+	if uuid == "" {
+		return "", fmt.Errorf("no manifest entry found for low_block_num %d", lowBlockNum)
+	}
+
+	return uuid, nil
+}
@@ -0,0 +1,118 @@
+package sftools
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestBundleUUID_DeterministicAndDivergent(t *testing.T) {
+	idsA := []string{"00000001", "00000002", "00000003"}
+	idsB := append([]string{}, idsA...) // same content, distinct slice
+	idsC := []string{"00000001", "00000002", "ffffffff"}
+
+	uuidA := bundleUUID(idsA)
+	uuidB := bundleUUID(idsB)
+	uuidC := bundleUUID(idsC)
+
+	if uuidA != uuidB {
+		t.Fatalf("bundleUUID(%v) = %s, bundleUUID(%v) = %s, want equal for identical block ids", idsA, uuidA, idsB, uuidB)
+	}
+	if uuidA == uuidC {
+		t.Fatalf("bundleUUID diverged block ids %v and %v produced the same UUID %s", idsA, idsC, uuidA)
+	}
+
+	idsD := []string{"ab", "c"}
+	idsE := []string{"a", "bc"}
+	if bundleUUID(idsD) == bundleUUID(idsE) {
+		t.Fatalf("bundleUUID(%v) collided with bundleUUID(%v): block IDs must be delimited, not just concatenated", idsD, idsE)
+	}
+}
+
+func TestAppendManifest_RoundTrip(t *testing.T) {
+	store := newFakeStore()
+	w := newMergedBlocksWriter(store, fakeBlockWriterFactory{}, 0, 0, zap.NewNop(), WithBundleManifest(""))
+
+	entries := []*BundleManifestEntry{
+		{LowBlockNum: 0, HighBlockNum: 1, UUID: "uuid-0", BlockIDs: []string{"a", "b"}},
+		{LowBlockNum: 2, HighBlockNum: 3, UUID: "uuid-2", BlockIDs: []string{"c", "d"}},
+	}
+	for _, e := range entries {
+		if err := w.appendManifest(e); err != nil {
+			t.Fatalf("appendManifest: %v", err)
+		}
+	}
+
+	data, err := readObject(context.Background(), store, defaultManifestFilename)
+	if err != nil {
+		t.Fatalf("reading manifest: %v", err)
+	}
+
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+	if len(lines) != len(entries) {
+		t.Fatalf("manifest has %d lines, want %d", len(lines), len(entries))
+	}
+	for i, line := range lines {
+		var got BundleManifestEntry
+		if err := json.Unmarshal(line, &got); err != nil {
+			t.Fatalf("decoding manifest line %d: %v", i, err)
+		}
+		if got.UUID != entries[i].UUID || got.LowBlockNum != entries[i].LowBlockNum {
+			t.Fatalf("manifest line %d = %+v, want %+v", i, got, entries[i])
+		}
+	}
+}
+
+func TestAppendManifest_PropagatesExistsError(t *testing.T) {
+	wantErr := errors.New("store unavailable")
+
+	store := newFakeStore()
+	store.failExists(defaultManifestFilename, wantErr)
+	w := newMergedBlocksWriter(store, fakeBlockWriterFactory{}, 0, 0, zap.NewNop(), WithBundleManifest(""))
+
+	err := w.appendManifest(&BundleManifestEntry{LowBlockNum: 0, HighBlockNum: 1, UUID: "uuid-0"})
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("appendManifest err = %v, want it to wrap %v instead of treating the failure as a missing manifest", err, wantErr)
+	}
+}
+
+// TestVerifyBundle_ContentAddressedNaming checks that a bundle written
+// with both WithContentAddressedNaming and WithSidecarIndex enabled can
+// still be located and verified by VerifyBundle, given its UUID.
+func TestVerifyBundle_ContentAddressedNaming(t *testing.T) {
+	store := newFakeStore()
+	w := newMergedBlocksWriter(store, fakeBlockWriterFactory{}, 0, 0, zap.NewNop(),
+		WithBundleSize(2), WithFirstStreamableBlock(0),
+		WithSidecarIndex(), WithContentAddressedNaming(), WithBundleManifest(""))
+
+	for n := uint64(0); n <= 1; n++ {
+		if err := w.ProcessBlock(testBlock(n), nil); err != nil {
+			t.Fatalf("ProcessBlock(%d): %v", n, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	data, err := readObject(context.Background(), store, defaultManifestFilename)
+	if err != nil {
+		t.Fatalf("reading manifest: %v", err)
+	}
+	var entry BundleManifestEntry
+	if err := json.Unmarshal(bytes.TrimRight(data, "\n"), &entry); err != nil {
+		t.Fatalf("decoding manifest entry: %v", err)
+	}
+
+	if err := VerifyBundle(context.Background(), store, sha256.New, 0, entry.UUID); err != nil {
+		t.Fatalf("VerifyBundle with the manifest-recovered uuid: %v", err)
+	}
+
+	if err := VerifyBundle(context.Background(), store, sha256.New, 0, ""); err == nil {
+		t.Fatalf("VerifyBundle without a uuid found a content-addressed bundle it shouldn't have")
+	}
+}
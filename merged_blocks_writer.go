@@ -1,12 +1,17 @@
 package sftools
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"github.com/streamingfast/bstream"
 	"github.com/streamingfast/dstore"
 	"go.uber.org/zap"
+	"hash"
 	"io"
+	"sync"
+	"time"
 )
 
 type mergedBlocksWriter struct {
@@ -20,9 +25,65 @@ type mergedBlocksWriter struct {
 	checkBundleSize bool
 
 	tweakBlock func(*bstream.Block) (*bstream.Block, error)
+
+	// pipelines uploads through a background pool instead of blocking
+	// ProcessBlock on the store write
+	uploadWorkers int
+
+	uploadOnce sync.Once
+	uploadJobs chan *bundleUpload
+	uploadWg   sync.WaitGroup
+	inFlight   sync.WaitGroup
+
+	// keep store writes in ascending lowBlockNum order despite being
+	// assembled concurrently
+	writeOrderMu   sync.Mutex
+	writeOrderCond *sync.Cond
+	nextWriteLow   uint64
+	writeOrderSet  bool
+
+	errMu sync.Mutex
+	err   error
+
+	sidecarEnabled bool // also write an era-style ".idx" sidecar, see era_index.go
+	hashFunc       func() hash.Hash
+	protocolID     uint32
+
+	contentAddressedNaming bool // suffix the bundle filename with bundleUUID
+
+	manifestEnabled  bool // append an entry to manifestFilename per bundle
+	manifestFilename string
+
+	manifestMu sync.Mutex // serializes appendManifest's read-modify-write cycle
+
+	strictDuplicateCheck bool // promote the duplicate checks to a hard error
+
+	bundleSize uint64 // blocks per bundle; zero falls back to 100
+
+	firstStreamableBlock    uint64 // overrides bstream.GetProtocolFirstStreamableBlock
+	firstStreamableBlockSet bool
+
+	// hold an assembled bundle in pending until confirmationDepth further
+	// blocks land on top of it, so a shallow reorg rolls back in memory
+	confirmationDepth uint64
+	pending           []*bundleUpload
+
+	orphanedBundleRecovery bool // let rollback delete an orphaned committed bundle, see reorg.go
+}
+
+// bundleUpload is the unit of work handed off to the upload worker pool:
+// a bundle's block range plus the blocks that compose it.
+type bundleUpload struct {
+	lowBlockNum uint64
+	blocks      []*bstream.Block
+	uuid        string
 }
 
 func (w *mergedBlocksWriter) ProcessBlock(blk *bstream.Block, obj interface{}) error {
+	if forkStep(obj) == bstream.StepUndo {
+		return w.rollback(blk)
+	}
+
 	if w.tweakBlock != nil {
 		b, err := w.tweakBlock(blk)
 		if err != nil {
@@ -31,19 +92,25 @@ func (w *mergedBlocksWriter) ProcessBlock(blk *bstream.Block, obj interface{}) e
 		blk = b
 	}
 
-	if w.lowBlockNum == 0 && blk.Number > 99 { // initial block
-		if blk.Number%100 != 0 && blk.Number != bstream.GetProtocolFirstStreamableBlock {
-			return fmt.Errorf("received unexpected block %s (not a boundary, not the first streamable block %d)", blk, bstream.GetProtocolFirstStreamableBlock)
+	bundleSize := w.effectiveBundleSize()
+	lastBundleBlock := w.lowBlockNum + bundleSize - 1
+
+	if w.lowBlockNum == 0 && blk.Number > bundleSize-1 { // initial block
+		firstStreamableBlock := w.effectiveFirstStreamableBlock()
+		if blk.Number%bundleSize != 0 && blk.Number != firstStreamableBlock {
+			return fmt.Errorf("received unexpected block %s (not a boundary, not the first streamable block %d)", blk, firstStreamableBlock)
 		}
-		w.lowBlockNum = lowBoundary(blk.Number)
+		w.lowBlockNum = w.lowBoundary(blk.Number)
+		lastBundleBlock = w.lowBlockNum + bundleSize - 1
 		w.logger.Debug("setting initial boundary to %d upon seeing block %s", zap.Uint64("low_boundary", w.lowBlockNum), zap.Stringer("blk", blk))
 	}
 
-	if blk.Number > w.lowBlockNum+99 {
-		w.logger.Debug("bundling because we saw block %s from next bundle (%d was not seen, it must not exist on this chain)", zap.Stringer("blk", blk), zap.Uint64("last_bundle_block", w.lowBlockNum+99))
+	if blk.Number > lastBundleBlock {
+		w.logger.Debug("bundling because we saw block %s from next bundle (%d was not seen, it must not exist on this chain)", zap.Stringer("blk", blk), zap.Uint64("last_bundle_block", lastBundleBlock))
 		if err := w.writeBundle(); err != nil {
 			return err
 		}
+		lastBundleBlock = w.lowBlockNum + bundleSize - 1
 	}
 
 	if w.stopBlockNum > 0 && blk.Number >= w.stopBlockNum {
@@ -52,12 +119,18 @@ func (w *mergedBlocksWriter) ProcessBlock(blk *bstream.Block, obj interface{}) e
 
 	w.blocks = append(w.blocks, blk)
 
-	if blk.Number == w.lowBlockNum+99 {
-		w.logger.Debug("bundling on last bundle block", zap.Uint64("last_bundle_block", w.lowBlockNum+99))
-		if w.checkBundleSize && len(w.blocks) != 100 && blk.Number >= 100 { // don't check the first bundle as the start block differs between blockchains
+	if w.confirmationDepth > 0 {
+		if err := w.releasePendingBundles(blk.Number); err != nil {
+			return err
+		}
+	}
+
+	if blk.Number == lastBundleBlock {
+		w.logger.Debug("bundling on last bundle block", zap.Uint64("last_bundle_block", lastBundleBlock))
+		if w.checkBundleSize && uint64(len(w.blocks)) != bundleSize && blk.Number >= bundleSize { // don't check the first bundle as the start block differs between blockchains
 			w.checkDuplicateNumbers()
 			w.checkDuplicateIds()
-			return fmt.Errorf("failed to check bundle size, expected 100 blocks but got %d at low_block_number %d", len(w.blocks), w.lowBlockNum)
+			return fmt.Errorf("failed to check bundle size, expected %d blocks but got %d at low_block_number %d", bundleSize, len(w.blocks), w.lowBlockNum)
 		}
 		if err := w.writeBundle(); err != nil {
 			return err
@@ -73,13 +146,90 @@ func filename(num uint64) string {
 }
 
 func (w *mergedBlocksWriter) writeBundle() error {
-	file := filename(w.lowBlockNum)
-	w.logger.Info("writing merged file to store (suffix: .dbin.zst)", zap.String("filename", file), zap.Uint64("lowBlockNum", w.lowBlockNum))
-
 	if len(w.blocks) == 0 {
 		return fmt.Errorf("no blocks to write to bundle")
 	}
 
+	if w.strictDuplicateCheck && (w.checkDuplicateNumbers() || w.checkDuplicateIds()) {
+		return fmt.Errorf("duplicate block number or id detected in bundle at low_block_number %d", w.lowBlockNum)
+	}
+
+	blockIDs := make([]string, len(w.blocks))
+	for i, blk := range w.blocks {
+		blockIDs[i] = blk.Id
+	}
+
+	job := &bundleUpload{lowBlockNum: w.lowBlockNum, blocks: w.blocks, uuid: bundleUUID(blockIDs)}
+	w.blocks = nil
+	w.lowBlockNum += w.effectiveBundleSize()
+
+	if w.confirmationDepth > 0 {
+		// held until confirmed, see releasePendingBundles
+		w.pending = append(w.pending, job)
+		return nil
+	}
+
+	return w.dispatch(job)
+}
+
+// dispatch hands a fully-assembled bundle off for upload, synchronously or
+// through the upload worker pool depending on uploadWorkers.
+func (w *mergedBlocksWriter) dispatch(job *bundleUpload) error {
+	if w.uploadWorkers <= 0 {
+		return w.uploadBundle(job)
+	}
+
+	w.startUploadWorkers()
+
+	// dispatch runs in ProcessBlock's order, so the first job handed off
+	// sets where the ascending write order starts
+	w.writeOrderMu.Lock()
+	if !w.writeOrderSet {
+		w.nextWriteLow = job.lowBlockNum
+		w.writeOrderSet = true
+	}
+	w.writeOrderMu.Unlock()
+
+	w.inFlight.Add(1)
+	w.uploadJobs <- job // blocks once the worker pool is saturated, bounding memory
+
+	return w.Err()
+}
+
+// startUploadWorkers lazily spins up the background upload pool.
+func (w *mergedBlocksWriter) startUploadWorkers() {
+	w.uploadOnce.Do(func() {
+		w.writeOrderCond = sync.NewCond(&w.writeOrderMu)
+		w.uploadJobs = make(chan *bundleUpload, w.uploadWorkers)
+		for i := 0; i < w.uploadWorkers; i++ {
+			w.uploadWg.Add(1)
+			go w.uploadWorkerLoop()
+		}
+	})
+}
+
+func (w *mergedBlocksWriter) uploadWorkerLoop() {
+	defer w.uploadWg.Done()
+	for job := range w.uploadJobs {
+		if err := w.uploadBundle(job); err != nil {
+			w.setErr(err)
+		}
+		w.inFlight.Done()
+	}
+}
+
+// uploadBundle serializes the job's blocks and pipes them to the store.
+// With the upload worker pool active, the store write is gated behind
+// writeOrderCond so concurrently-assembled bundles still land in ascending
+// lowBlockNum order.
+func (w *mergedBlocksWriter) uploadBundle(job *bundleUpload) error {
+	file := w.bundleFilename(job)
+	w.logger.Info("writing merged file to store (suffix: .dbin.zst)", zap.String("filename", file), zap.Uint64("lowBlockNum", job.lowBlockNum), zap.String("uuid", job.uuid))
+
+	if w.sidecarEnabled {
+		return w.uploadBundleWithSidecar(job, file)
+	}
+
 	pr, pw := io.Pipe()
 
 	go func() {
@@ -93,7 +243,7 @@ func (w *mergedBlocksWriter) writeBundle() error {
 			return
 		}
 
-		for _, blk := range w.blocks {
+		for _, blk := range job.blocks {
 			err = blockWriter.Write(blk)
 			if err != nil {
 				return
@@ -101,45 +251,266 @@ func (w *mergedBlocksWriter) writeBundle() error {
 		}
 	}()
 
-	err := w.store.WriteObject(context.Background(), file, pr)
-	if err != nil {
+	if err := w.writeBundleObject(job, file, pr); err != nil {
 		w.logger.Error("writing to store", zap.Error(err))
+		return err
 	}
 
-	w.lowBlockNum += 100
-	w.blocks = nil
+	return w.recordManifestEntry(job)
+}
+
+// writeBundleObject waits for job's turn in ascending lowBlockNum order,
+// then writes r to file under that name. If a lower-numbered bundle has
+// already failed, it refuses to write and returns that same error instead,
+// closing r first if it's a pipe so uploadBundle's writer goroutine doesn't
+// block forever on a reader nobody's draining.
+func (w *mergedBlocksWriter) writeBundleObject(job *bundleUpload, file string, r io.Reader) error {
+	w.waitForWriteTurn(job.lowBlockNum)
+
+	if err := w.Err(); err != nil {
+		w.advanceWriteTurn(job.lowBlockNum)
+		if pr, ok := r.(*io.PipeReader); ok {
+			pr.CloseWithError(err)
+		}
+		return err
+	}
+
+	err := w.store.WriteObject(context.Background(), file, r)
+	if err != nil {
+		w.setErr(err)
+	}
+	w.advanceWriteTurn(job.lowBlockNum)
 
 	return err
 }
 
-func lowBoundary(i uint64) uint64 {
-	return i - (i % 100)
+func (w *mergedBlocksWriter) bundleFilename(job *bundleUpload) string {
+	if !w.contentAddressedNaming {
+		return filename(job.lowBlockNum)
+	}
+	return bundleObjectName(job.lowBlockNum, job.uuid)
+}
+
+// bundleObjectName is the read-side counterpart to bundleFilename, used
+// by VerifyBundle to locate a bundle it didn't write itself.
+func bundleObjectName(lowBlockNum uint64, uuid string) string {
+	base := filename(lowBlockNum)
+	if uuid == "" {
+		return base
+	}
+	return fmt.Sprintf("%s-%s", base, uuid)
+}
+
+// recordManifestEntry appends a manifest entry for a just-written bundle
+// when WithBundleManifest is set; it's a no-op otherwise.
+func (w *mergedBlocksWriter) recordManifestEntry(job *bundleUpload) error {
+	if !w.manifestEnabled {
+		return nil
+	}
+
+	blockIDs := make([]string, len(job.blocks))
+	for i, blk := range job.blocks {
+		blockIDs[i] = blk.Id
+	}
+
+	return w.appendManifest(&BundleManifestEntry{
+		LowBlockNum:  job.lowBlockNum,
+		HighBlockNum: job.lowBlockNum + uint64(len(job.blocks)) - 1,
+		UUID:         job.uuid,
+		BlockIDs:     blockIDs,
+		ProducedAt:   time.Now(),
+	})
+}
+
+// uploadBundleWithSidecar serializes the bundle into memory (rather than
+// streaming it through a pipe) so it can record each block's exact byte
+// range and hash, then writes both the bundle and its era-style ".idx"
+// sidecar to the store.
+func (w *mergedBlocksWriter) uploadBundleWithSidecar(job *bundleUpload, file string) error {
+	buf := &bytes.Buffer{}
+	blockWriter, err := w.writerFactory.New(buf)
+	if err != nil {
+		return fmt.Errorf("creating block writer for bundle %s: %w", file, err)
+	}
+
+	hashFn := w.effectiveHashFunc()
+	records := make([]blockHashRecord, 0, len(job.blocks))
+	for _, blk := range job.blocks {
+		start := buf.Len()
+		if err := blockWriter.Write(blk); err != nil {
+			return fmt.Errorf("writing block %s to bundle %s: %w", blk, file, err)
+		}
+		end := buf.Len()
+
+		h := hashFn()
+		h.Write(buf.Bytes()[start:end])
+		records = append(records, blockHashRecord{
+			blockNum: blk.Number,
+			blockID:  blk.Id,
+			offset:   uint64(start),
+			length:   uint64(end - start),
+			sum:      h.Sum(nil),
+		})
+	}
+
+	if err := w.writeBundleObject(job, file, bytes.NewReader(buf.Bytes())); err != nil {
+		w.logger.Error("writing to store", zap.Error(err))
+		return err
+	}
+
+	sidecar := newEraIndex(job.lowBlockNum, w.protocolID, records, hashFn)
+	if err := w.store.WriteObject(context.Background(), file+eraIndexSuffix, bytes.NewReader(sidecar)); err != nil {
+		w.logger.Error("writing sidecar index to store", zap.Error(err), zap.String("filename", file))
+		return fmt.Errorf("writing sidecar index for bundle %s: %w", file, err)
+	}
+
+	return w.recordManifestEntry(job)
+}
+
+// effectiveHashFunc falls back to SHA-256 when hashFunc is unset.
+func (w *mergedBlocksWriter) effectiveHashFunc() func() hash.Hash {
+	if w.hashFunc != nil {
+		return w.hashFunc
+	}
+	return sha256.New
+}
+
+// waitForWriteTurn blocks until every lower-numbered bundle has written.
+func (w *mergedBlocksWriter) waitForWriteTurn(lowBlockNum uint64) {
+	if w.uploadWorkers <= 0 {
+		return
+	}
+
+	w.writeOrderMu.Lock()
+	defer w.writeOrderMu.Unlock()
+
+	if !w.writeOrderSet {
+		w.nextWriteLow = lowBlockNum
+		w.writeOrderSet = true
+	}
+
+	for w.nextWriteLow != lowBlockNum {
+		w.writeOrderCond.Wait()
+	}
+}
+
+func (w *mergedBlocksWriter) advanceWriteTurn(lowBlockNum uint64) {
+	if w.uploadWorkers <= 0 {
+		return
+	}
+
+	w.writeOrderMu.Lock()
+	w.nextWriteLow = lowBlockNum + w.effectiveBundleSize()
+	w.writeOrderMu.Unlock()
+	w.writeOrderCond.Broadcast()
+}
+
+func (w *mergedBlocksWriter) setErr(err error) {
+	if err == nil {
+		return
+	}
+	w.errMu.Lock()
+	defer w.errMu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// Err returns the first error observed by a background upload worker, if any.
+func (w *mergedBlocksWriter) Err() error {
+	w.errMu.Lock()
+	defer w.errMu.Unlock()
+	return w.err
+}
+
+// Flush blocks until every bundle handed off to the upload worker pool has
+// either landed in the store or failed, then returns the first error.
+func (w *mergedBlocksWriter) Flush() error {
+	w.inFlight.Wait()
+	return w.Err()
+}
+
+// Close flushes all in-flight uploads, shuts down the upload worker pool,
+// and returns the first error from committing a pending bundle, from a
+// bundle's store write, or from a background upload worker. Other errors
+// that ProcessBlock returned to its caller are not returned again. After
+// Close returns, the writer must not be reused.
+func (w *mergedBlocksWriter) Close() error {
+	if err := w.flushPending(); err != nil {
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if w.uploadJobs != nil {
+		close(w.uploadJobs)
+		w.uploadWg.Wait()
+	}
+
+	return w.Err()
+}
+
+// effectiveBundleSize falls back to the historical 100-block bundle when
+// bundleSize is unset.
+func (w *mergedBlocksWriter) effectiveBundleSize() uint64 {
+	if w.bundleSize == 0 {
+		return 100
+	}
+	return w.bundleSize
+}
+
+// effectiveFirstStreamableBlock falls back to
+// bstream.GetProtocolFirstStreamableBlock unless overridden.
+func (w *mergedBlocksWriter) effectiveFirstStreamableBlock() uint64 {
+	if w.firstStreamableBlockSet {
+		return w.firstStreamableBlock
+	}
+	return bstream.GetProtocolFirstStreamableBlock
 }
 
-func (w *mergedBlocksWriter) checkDuplicateNumbers() {
+func (w *mergedBlocksWriter) lowBoundary(i uint64) uint64 {
+	size := w.effectiveBundleSize()
+	return i - (i % size)
+}
 
+// checkDuplicateNumbers logs every duplicate block number found in the
+// current bundle and reports whether any were found, so callers can
+// choose whether that's merely worth logging or a hard error.
+func (w *mergedBlocksWriter) checkDuplicateNumbers() bool {
+	found := false
 	blockMap := make(map[uint64]*bstream.Block)
 
 	for _, b := range w.blocks {
 		if block, ok := blockMap[b.Number]; ok {
+			found = true
 			w.logger.Error("found duplicate block number in bundle", zap.Uint64("block_num", b.Number),
 				zap.Any("block1", b), zap.Any("block2", block))
 		} else {
 			blockMap[b.Number] = b
 		}
 	}
-}
 
-func (w *mergedBlocksWriter) checkDuplicateIds() {
+	return found
+}
 
+// checkDuplicateIds logs every duplicate block ID found in the current
+// bundle and reports whether any were found, so callers can choose
+// whether that's merely worth logging or a hard error.
+func (w *mergedBlocksWriter) checkDuplicateIds() bool {
+	found := false
 	blockMap := make(map[string]*bstream.Block)
 
 	for _, b := range w.blocks {
 		if block, ok := blockMap[b.Id]; ok {
+			found = true
 			w.logger.Error("found duplicate block id in bundle", zap.String("block_id", b.Id),
 				zap.Any("block1", b), zap.Any("block2", block))
 		} else {
 			blockMap[b.Id] = b
 		}
 	}
+
+	return found
 }
@@ -0,0 +1,131 @@
+package sftools
+
+import (
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func newTestWriter(store *fakeStore, opts ...MergedBlocksWriterOption) *mergedBlocksWriter {
+	opts = append([]MergedBlocksWriterOption{WithBundleSize(2), WithFirstStreamableBlock(0)}, opts...)
+	return newMergedBlocksWriter(store, fakeBlockWriterFactory{}, 0, 0, zap.NewNop(), opts...)
+}
+
+func feedBlocks(t *testing.T, w *mergedBlocksWriter, upTo uint64) {
+	t.Helper()
+	for n := uint64(0); n <= upTo; n++ {
+		if err := w.ProcessBlock(testBlock(n), nil); err != nil && err != io.EOF {
+			return
+		}
+	}
+}
+
+// TestMergedBlocksWriter_UploadWorkers_OrderingUnderSlowWrites fault-injects
+// a slow store write on an early bundle while later bundles write
+// instantly, and checks that the upload worker pool still lands every
+// bundle in the store in ascending lowBlockNum order rather than in
+// whichever order the underlying writes actually completed.
+func TestMergedBlocksWriter_UploadWorkers_OrderingUnderSlowWrites(t *testing.T) {
+	store := newFakeStore()
+	store.delayWrite(filename(2), 30*time.Millisecond)
+
+	w := newTestWriter(store, WithUploadWorkers(4))
+	feedBlocks(t, w, 7) // bundles [0,1] [2,3] [4,5] [6,7]
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	want := []string{filename(0), filename(2), filename(4), filename(6)}
+	if len(store.writeOrder) != len(want) {
+		t.Fatalf("writeOrder = %v, want %v", store.writeOrder, want)
+	}
+	for i, name := range want {
+		if store.writeOrder[i] != name {
+			t.Fatalf("writeOrder[%d] = %s, want %s (full order: %v)", i, store.writeOrder[i], name, store.writeOrder)
+		}
+	}
+}
+
+// TestMergedBlocksWriter_UploadWorkers_ErrorPropagation checks that once a
+// bundle fails to write, the error surfaces from Close and no
+// later-numbered bundle silently lands in the store on top of the gap the
+// failure left behind.
+func TestMergedBlocksWriter_UploadWorkers_ErrorPropagation(t *testing.T) {
+	wantErr := errors.New("store unavailable")
+
+	store := newFakeStore()
+	store.failWrite(filename(2), wantErr)
+
+	w := newTestWriter(store, WithUploadWorkers(4))
+	feedBlocks(t, w, 7) // bundles [0,1] [2,3] [4,5] [6,7]
+
+	err := w.Close()
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("Close err = %v, want %v", err, wantErr)
+	}
+
+	for _, name := range store.objectNames() {
+		if name == filename(4) || name == filename(6) {
+			t.Fatalf("bundle %s landed in the store after an earlier bundle failed, leaving no gap when there should be one", name)
+		}
+	}
+	if _, err := store.OpenObject(context.Background(), filename(0)); err != nil {
+		t.Fatalf("expected bundle %s (written before the failure) to be in the store: %v", filename(0), err)
+	}
+}
+
+// TestMergedBlocksWriter_UploadWorkers_ErrorPropagation_NoGoroutineLeak
+// checks that bundles dispatched after an earlier one has failed don't
+// each leak the goroutine streaming blocks into their (never-read) pipe.
+func TestMergedBlocksWriter_UploadWorkers_ErrorPropagation_NoGoroutineLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	store := newFakeStore()
+	store.failWrite(filename(2), errors.New("store unavailable"))
+
+	w := newTestWriter(store, WithUploadWorkers(4))
+	feedBlocks(t, w, 7) // bundles [0,1] [2,3] [4,5] [6,7]
+	w.Close()
+
+	var after int
+	for i := 0; i < 50; i++ {
+		runtime.Gosched()
+		after = runtime.NumGoroutine()
+		if after <= before {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if after > before {
+		t.Fatalf("goroutine count = %d after Close, want <= %d (pre-test baseline): a bundle's pipe writer goroutine leaked", after, before)
+	}
+}
+
+// TestMergedBlocksWriter_SynchronousUploadPreservesOrder checks the
+// historical, non-pooled path (uploadWorkers == 0) still writes bundles
+// in order with no pool involved at all.
+func TestMergedBlocksWriter_SynchronousUploadPreservesOrder(t *testing.T) {
+	store := newFakeStore()
+	w := newTestWriter(store)
+	feedBlocks(t, w, 5) // bundles [0,1] [2,3] [4,5]
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	want := []string{filename(0), filename(2), filename(4)}
+	if len(store.writeOrder) != len(want) {
+		t.Fatalf("writeOrder = %v, want %v", store.writeOrder, want)
+	}
+	for i, name := range want {
+		if store.writeOrder[i] != name {
+			t.Fatalf("writeOrder[%d] = %s, want %s", i, store.writeOrder[i], name)
+		}
+	}
+}
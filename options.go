@@ -0,0 +1,149 @@
+package sftools
+
+import (
+	"crypto/sha256"
+	"hash"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
+	"go.uber.org/zap"
+)
+
+// MergedBlocksWriterOption configures optional behavior of a
+// mergedBlocksWriter at construction time.
+type MergedBlocksWriterOption func(*mergedBlocksWriter)
+
+// WithUploadWorkers pipelines bundle uploads through a pool of n
+// background goroutines instead of blocking ProcessBlock on the store
+// write. See mergedBlocksWriter.uploadWorkers.
+func WithUploadWorkers(n int) MergedBlocksWriterOption {
+	return func(w *mergedBlocksWriter) {
+		w.uploadWorkers = n
+	}
+}
+
+// WithSidecarIndex enables writing an era-style sidecar index (see
+// era_index.go) alongside every bundle, giving O(1) random access and
+// per-block integrity checks without decoding the whole bundle.
+func WithSidecarIndex() MergedBlocksWriterOption {
+	return func(w *mergedBlocksWriter) {
+		w.sidecarEnabled = true
+	}
+}
+
+// WithSidecarHashFunc overrides the hash function used to compute
+// per-block hashes and the Merkle accumulator root in the sidecar index.
+// It defaults to SHA-256.
+func WithSidecarHashFunc(hashFn func() hash.Hash) MergedBlocksWriterOption {
+	return func(w *mergedBlocksWriter) {
+		w.hashFunc = hashFn
+	}
+}
+
+// WithProtocolID stamps the sidecar index header with a caller-defined
+// protocol identifier, letting a verifier reject a sidecar produced for
+// the wrong chain.
+func WithProtocolID(id uint32) MergedBlocksWriterOption {
+	return func(w *mergedBlocksWriter) {
+		w.protocolID = id
+	}
+}
+
+// WithContentAddressedNaming suffixes every bundle's filename with a
+// deterministic UUID derived from its block IDs (see bundleUUID), so two
+// producers that assembled different contents for the same range never
+// silently overwrite each other.
+func WithContentAddressedNaming() MergedBlocksWriterOption {
+	return func(w *mergedBlocksWriter) {
+		w.contentAddressedNaming = true
+	}
+}
+
+// WithBundleManifest enables appending a {range, uuid, block_ids,
+// produced_at} entry to a rolling manifest object in the same store
+// after every bundle write, letting a reader detect divergence between
+// two merger instances. filename defaults to "bundles.manifest.jsonl"
+// when empty.
+//
+// The manifest is read-modify-written with no cross-process locking, so
+// two merger instances (or two processes sharing a store) appending
+// concurrently can race and drop one another's entry; it only protects
+// against concurrent upload workers within a single process.
+func WithBundleManifest(filename string) MergedBlocksWriterOption {
+	if filename == "" {
+		filename = defaultManifestFilename
+	}
+	return func(w *mergedBlocksWriter) {
+		w.manifestEnabled = true
+		w.manifestFilename = filename
+	}
+}
+
+// WithStrictDuplicateCheck promotes checkDuplicateNumbers/checkDuplicateIds
+// from a logged warning to a hard error returned by writeBundle.
+func WithStrictDuplicateCheck() MergedBlocksWriterOption {
+	return func(w *mergedBlocksWriter) {
+		w.strictDuplicateCheck = true
+	}
+}
+
+// WithBundleSize overrides the number of blocks per bundle. It defaults
+// to 100 when unset, matching the merged-blocks bundles produced
+// historically.
+func WithBundleSize(size uint64) MergedBlocksWriterOption {
+	return func(w *mergedBlocksWriter) {
+		w.bundleSize = size
+	}
+}
+
+// WithFirstStreamableBlock overrides the block number allowed to start a
+// short first bundle, in place of bstream.GetProtocolFirstStreamableBlock.
+func WithFirstStreamableBlock(blockNum uint64) MergedBlocksWriterOption {
+	return func(w *mergedBlocksWriter) {
+		w.firstStreamableBlock = blockNum
+		w.firstStreamableBlockSet = true
+	}
+}
+
+// WithConfirmationDepth delays committing an assembled bundle to the
+// store until depth further blocks have landed on top of it, so a reorg
+// within that window rolls back in memory instead of touching the store.
+// Requires obj passed to ProcessBlock to be a *forkable.ForkableObject
+// for undo detection to take effect.
+func WithConfirmationDepth(depth uint64) MergedBlocksWriterOption {
+	return func(w *mergedBlocksWriter) {
+		w.confirmationDepth = depth
+	}
+}
+
+// WithOrphanedBundleRecovery lets a reorg that undoes a block belonging to
+// a bundle already committed to the store delete that bundle instead of
+// returning a hard error demanding manual intervention; the writer then
+// resumes assembling a fresh bundle from the deleted one's low block num.
+// With WithContentAddressedNaming, this also requires WithBundleManifest
+// to recover the bundle's uuid suffix.
+func WithOrphanedBundleRecovery() MergedBlocksWriterOption {
+	return func(w *mergedBlocksWriter) {
+		w.orphanedBundleRecovery = true
+	}
+}
+
+const defaultManifestFilename = "bundles.manifest.jsonl"
+
+func newMergedBlocksWriter(store dstore.Store, writerFactory bstream.BlockWriterFactory, lowBlockNum, stopBlockNum uint64, logger *zap.Logger, opts ...MergedBlocksWriterOption) *mergedBlocksWriter {
+	w := &mergedBlocksWriter{
+		store:            store,
+		writerFactory:    writerFactory,
+		lowBlockNum:      lowBlockNum,
+		stopBlockNum:     stopBlockNum,
+		logger:           logger,
+		hashFunc:         sha256.New,
+		manifestFilename: defaultManifestFilename,
+	}
+
+	for _, opt := range opts {
+		opt(w)
+	}
+
+	return w
+}
@@ -0,0 +1,111 @@
+package sftools
+
+import (
+	"testing"
+
+	"github.com/streamingfast/bstream"
+	"go.uber.org/zap"
+)
+
+func TestEffectiveBundleSize(t *testing.T) {
+	cases := []struct {
+		name string
+		size uint64
+		want uint64
+	}{
+		{name: "unset falls back to 100", size: 0, want: 100},
+		{name: "explicit size honored", size: 1000, want: 1000},
+		{name: "small size honored", size: 1, want: 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := &mergedBlocksWriter{bundleSize: c.size}
+			if got := w.effectiveBundleSize(); got != c.want {
+				t.Fatalf("effectiveBundleSize() = %d, want %d", got, c.want)
+			}
+		})
+	}
+}
+
+func TestEffectiveFirstStreamableBlock(t *testing.T) {
+	cases := []struct {
+		name string
+		set  bool
+		val  uint64
+		want uint64
+	}{
+		{name: "unset falls back to protocol default", set: false, val: 0, want: bstream.GetProtocolFirstStreamableBlock},
+		{name: "override honored, including zero", set: true, val: 0, want: 0},
+		{name: "override honored, non-zero", set: true, val: 42, want: 42},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := &mergedBlocksWriter{firstStreamableBlock: c.val, firstStreamableBlockSet: c.set}
+			if got := w.effectiveFirstStreamableBlock(); got != c.want {
+				t.Fatalf("effectiveFirstStreamableBlock() = %d, want %d", got, c.want)
+			}
+		})
+	}
+}
+
+func TestLowBoundary(t *testing.T) {
+	cases := []struct {
+		name       string
+		bundleSize uint64
+		blockNum   uint64
+		want       uint64
+	}{
+		{name: "exact boundary", bundleSize: 100, blockNum: 200, want: 200},
+		{name: "mid bundle", bundleSize: 100, blockNum: 250, want: 200},
+		{name: "just before next boundary", bundleSize: 100, blockNum: 299, want: 200},
+		{name: "small bundle size", bundleSize: 1, blockNum: 7, want: 7},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := &mergedBlocksWriter{bundleSize: c.bundleSize}
+			if got := w.lowBoundary(c.blockNum); got != c.want {
+				t.Fatalf("lowBoundary(%d) = %d, want %d", c.blockNum, got, c.want)
+			}
+		})
+	}
+}
+
+// TestProcessBlock_InitialBoundary is table-driven over the two ways a
+// merger is allowed to start a bundle window: on an ordinary bundle-size
+// boundary, or on the configured first streamable block even when that
+// isn't boundary-aligned (as is the case for several real chains). Any
+// other starting block past the first bundle window must be rejected; a
+// first block inside that window is accepted without the check.
+func TestProcessBlock_InitialBoundary(t *testing.T) {
+	cases := []struct {
+		name            string
+		bundleSize      uint64
+		firstStreamable uint64
+		firstBlock      uint64
+		wantErr         bool
+	}{
+		{name: "starts on bundle boundary", bundleSize: 10, firstStreamable: 0, firstBlock: 20, wantErr: false},
+		{name: "starts on non-boundary first streamable block", bundleSize: 10, firstStreamable: 15, firstBlock: 15, wantErr: false},
+		{name: "starts on neither", bundleSize: 10, firstStreamable: 5, firstBlock: 17, wantErr: true},
+		{name: "first block within the first bundle window needs no check", bundleSize: 10, firstStreamable: 0, firstBlock: 3, wantErr: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			store := newFakeStore()
+			w := newMergedBlocksWriter(store, fakeBlockWriterFactory{}, 0, 0, zap.NewNop(),
+				WithBundleSize(c.bundleSize), WithFirstStreamableBlock(c.firstStreamable))
+
+			err := w.ProcessBlock(testBlock(c.firstBlock), nil)
+			if c.wantErr && err == nil {
+				t.Fatalf("ProcessBlock(%d) = nil, want an error (bundleSize=%d, firstStreamable=%d)", c.firstBlock, c.bundleSize, c.firstStreamable)
+			}
+			if !c.wantErr && err != nil {
+				t.Fatalf("ProcessBlock(%d) = %v, want no error (bundleSize=%d, firstStreamable=%d)", c.firstBlock, err, c.bundleSize, c.firstStreamable)
+			}
+		})
+	}
+}
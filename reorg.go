@@ -0,0 +1,150 @@
+package sftools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/bstream/forkable"
+	"go.uber.org/zap"
+)
+
+// forkStep extracts the bstream.StepType carried by obj. Blocks delivered
+// without a *forkable.ForkableObject are treated as StepNew.
+func forkStep(obj interface{}) bstream.StepType {
+	if fo, ok := obj.(*forkable.ForkableObject); ok {
+		return fo.Step
+	}
+	return bstream.StepNew
+}
+
+// rollback undoes blk and everything assembled on top of it, whether
+// that's still in the open w.blocks window or already closed into a
+// pending bundle. Bundles already committed to the store are handled
+// further below: an error, or their deletion with WithOrphanedBundleRecovery.
+func (w *mergedBlocksWriter) rollback(blk *bstream.Block) error {
+	for pi := len(w.pending) - 1; pi >= 0; pi-- {
+		job := w.pending[pi]
+		for i, b := range job.blocks {
+			if b.Id != blk.Id {
+				continue
+			}
+
+			w.logger.Info("rolling back pending bundle on reorg",
+				zap.Stringer("undone_block", blk),
+				zap.Uint64("bundle_low_block_num", job.lowBlockNum),
+				zap.Int("blocks_dropped", len(job.blocks)-i))
+
+			// only the surviving prefix goes back into the assembly window;
+			// the open window and later pending bundles were built on top of
+			// the undone block and are discarded outright
+			w.blocks = append([]*bstream.Block{}, job.blocks[:i]...)
+			w.pending = w.pending[:pi]
+			w.lowBlockNum = job.lowBlockNum
+
+			return nil
+		}
+	}
+
+	for i, b := range w.blocks {
+		if b.Id != blk.Id {
+			continue
+		}
+
+		w.logger.Info("rolling back bundle on reorg", zap.Stringer("undone_block", blk), zap.Int("blocks_dropped", len(w.blocks)-i))
+		w.blocks = w.blocks[:i]
+
+		return nil
+	}
+
+	if blk.Number < w.lowBlockNum {
+		// the undone block belongs to a bundle already committed to the
+		// store; we no longer hold its blocks in memory
+		low := w.lowBoundary(blk.Number)
+
+		if !w.orphanedBundleRecovery {
+			return fmt.Errorf("reorg undid block %s which belongs to a bundle already committed to the store (low_block_num %d); manual intervention required", blk, low)
+		}
+
+		if err := w.deleteCommittedBundle(low); err != nil {
+			return fmt.Errorf("reorg undid block %s which belongs to a bundle already committed to the store (low_block_num %d), and recovering it failed: %w", blk, low, err)
+		}
+
+		w.logger.Warn("deleted a committed bundle orphaned by a reorg, resuming assembly from its low block num",
+			zap.Stringer("undone_block", blk), zap.Uint64("low_block_num", low))
+		w.blocks = nil
+		w.lowBlockNum = low
+
+		return nil
+	}
+
+	w.logger.Warn("received undo for a block outside the current bundle window, ignoring", zap.Stringer("undone_block", blk))
+
+	return nil
+}
+
+// deleteCommittedBundle removes the bundle (and its sidecar, if enabled)
+// at low from the store. With content-addressed naming, its uuid suffix
+// is recovered from the manifest.
+func (w *mergedBlocksWriter) deleteCommittedBundle(low uint64) error {
+	uuid := ""
+	if w.contentAddressedNaming {
+		if !w.manifestEnabled {
+			return fmt.Errorf("cannot locate a content-addressed bundle for low_block_num %d without a manifest (see WithBundleManifest)", low)
+		}
+		u, err := w.findManifestUUID(low)
+		if err != nil {
+			return err
+		}
+		uuid = u
+	}
+
+	file := bundleObjectName(low, uuid)
+	ctx := context.Background()
+
+	if err := w.store.DeleteObject(ctx, file); err != nil {
+		return fmt.Errorf("deleting orphaned bundle %s: %w", file, err)
+	}
+
+	if w.sidecarEnabled {
+		if err := w.store.DeleteObject(ctx, file+eraIndexSuffix); err != nil {
+			return fmt.Errorf("deleting sidecar index for orphaned bundle %s: %w", file, err)
+		}
+	}
+
+	return nil
+}
+
+// flushPending commits every remaining pending bundle regardless of
+// confirmation depth. Used on Close.
+func (w *mergedBlocksWriter) flushPending() error {
+	pending := w.pending
+	w.pending = nil
+
+	for _, job := range pending {
+		if err := w.dispatch(job); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// releasePendingBundles commits every pending bundle whose tip has
+// reached confirmationDepth as of tipBlockNum, oldest first.
+func (w *mergedBlocksWriter) releasePendingBundles(tipBlockNum uint64) error {
+	for len(w.pending) > 0 {
+		job := w.pending[0]
+		lastBlockNum := job.lowBlockNum + uint64(len(job.blocks)) - 1
+		if tipBlockNum < lastBlockNum+w.confirmationDepth {
+			break
+		}
+
+		w.pending = w.pending[1:]
+		if err := w.dispatch(job); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
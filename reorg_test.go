@@ -0,0 +1,208 @@
+package sftools
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/bstream/forkable"
+	"go.uber.org/zap"
+)
+
+var undoStep = &forkable.ForkableObject{Step: bstream.StepUndo}
+
+func testForkBlock(number uint64, fork string) *bstream.Block {
+	return &bstream.Block{
+		Id:         fork + "-" + testBlock(number).Id,
+		Number:     number,
+		PreviousId: fork + "-" + testBlock(number-1).Id,
+	}
+}
+
+// TestRollback_WithinOpenWindow covers a shallow reorg: the undone block is
+// still sitting in the writer's open assembly window, nothing has been
+// bundled yet.
+func TestRollback_WithinOpenWindow(t *testing.T) {
+	store := newFakeStore()
+	w := newMergedBlocksWriter(store, fakeBlockWriterFactory{}, 0, 0, zap.NewNop(),
+		WithBundleSize(10), WithFirstStreamableBlock(0))
+
+	for n := uint64(0); n <= 2; n++ {
+		if err := w.ProcessBlock(testBlock(n), nil); err != nil {
+			t.Fatalf("ProcessBlock(%d): %v", n, err)
+		}
+	}
+
+	if err := w.ProcessBlock(testBlock(2), undoStep); err != nil {
+		t.Fatalf("undo block 2: %v", err)
+	}
+
+	if len(w.blocks) != 2 {
+		t.Fatalf("len(w.blocks) = %d, want 2 after undoing block 2", len(w.blocks))
+	}
+	if w.blocks[len(w.blocks)-1].Number != 1 {
+		t.Fatalf("last remaining block = %d, want 1", w.blocks[len(w.blocks)-1].Number)
+	}
+}
+
+// TestRollback_WithinPendingBundle covers a reorg that reaches into a
+// bundle that's already been assembled and closed, but is still being
+// held back by WithConfirmationDepth rather than committed to the store.
+func TestRollback_WithinPendingBundle(t *testing.T) {
+	store := newFakeStore()
+	w := newMergedBlocksWriter(store, fakeBlockWriterFactory{}, 0, 0, zap.NewNop(),
+		WithBundleSize(2), WithFirstStreamableBlock(0), WithConfirmationDepth(2))
+
+	for n := uint64(0); n <= 2; n++ {
+		if err := w.ProcessBlock(testBlock(n), nil); err != nil {
+			t.Fatalf("ProcessBlock(%d): %v", n, err)
+		}
+	}
+
+	if len(w.pending) != 1 {
+		t.Fatalf("len(w.pending) = %d, want 1 (bundle [0,1] held back by confirmation depth)", len(w.pending))
+	}
+
+	if err := w.ProcessBlock(testBlock(0), undoStep); err != nil {
+		t.Fatalf("undo block 0: %v", err)
+	}
+
+	if len(w.pending) != 0 {
+		t.Fatalf("len(w.pending) = %d, want 0 after undoing the pending bundle's first block", len(w.pending))
+	}
+	if w.lowBlockNum != 0 {
+		t.Fatalf("lowBlockNum = %d, want 0 after the pending bundle was rolled back", w.lowBlockNum)
+	}
+	if len(w.blocks) != 0 {
+		t.Fatalf("w.blocks = %v, want empty: block 2 was built on top of the undone block 0", w.blocks)
+	}
+	if len(store.objectNames()) != 0 {
+		t.Fatalf("store has objects %v, want none: the bundle was never committed", store.objectNames())
+	}
+}
+
+// TestRollback_CommittedBundle_WithoutRecovery covers a reorg deep enough
+// to undo a block in an already-committed bundle, with no recovery option
+// configured: it must refuse rather than silently leave an orphaned block
+// in the store.
+func TestRollback_CommittedBundle_WithoutRecovery(t *testing.T) {
+	store := newFakeStore()
+	w := newMergedBlocksWriter(store, fakeBlockWriterFactory{}, 0, 0, zap.NewNop(),
+		WithBundleSize(2), WithFirstStreamableBlock(0))
+
+	for n := uint64(0); n <= 2; n++ {
+		if err := w.ProcessBlock(testBlock(n), nil); err != nil {
+			t.Fatalf("ProcessBlock(%d): %v", n, err)
+		}
+	}
+
+	err := w.ProcessBlock(testBlock(0), undoStep)
+	if err == nil {
+		t.Fatalf("undo of a committed block = nil error, want a refusal")
+	}
+	if _, openErr := store.OpenObject(context.Background(), filename(0)); openErr != nil {
+		t.Fatalf("committed bundle %s should be left untouched: %v", filename(0), openErr)
+	}
+}
+
+// TestRollback_CommittedBundle_WithRecovery covers the opt-in path: the
+// writer deletes the orphaned bundle and resumes assembly from its low
+// block num, so a resumed feed of the winning fork's blocks can rewrite it.
+func TestRollback_CommittedBundle_WithRecovery(t *testing.T) {
+	store := newFakeStore()
+	w := newMergedBlocksWriter(store, fakeBlockWriterFactory{}, 0, 0, zap.NewNop(),
+		WithBundleSize(2), WithFirstStreamableBlock(0), WithOrphanedBundleRecovery())
+
+	for n := uint64(0); n <= 2; n++ {
+		if err := w.ProcessBlock(testBlock(n), nil); err != nil {
+			t.Fatalf("ProcessBlock(%d): %v", n, err)
+		}
+	}
+
+	if err := w.ProcessBlock(testBlock(0), undoStep); err != nil {
+		t.Fatalf("undo of a committed block with recovery enabled: %v", err)
+	}
+	if _, openErr := store.OpenObject(context.Background(), filename(0)); openErr == nil {
+		t.Fatalf("bundle %s should have been deleted after the orphaning reorg", filename(0))
+	}
+	if w.lowBlockNum != 0 {
+		t.Fatalf("lowBlockNum = %d, want 0 to resume assembly from the deleted bundle", w.lowBlockNum)
+	}
+	if len(w.blocks) != 0 {
+		t.Fatalf("w.blocks = %v, want empty: the discarded chain can't be replayed into the recovered window", w.blocks)
+	}
+
+	for n := uint64(0); n <= 1; n++ {
+		if err := w.ProcessBlock(testForkBlock(n, "fork"), nil); err != nil {
+			t.Fatalf("ProcessBlock(fork block %d): %v", n, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	rewritten, err := store.OpenObject(context.Background(), filename(0))
+	if err != nil {
+		t.Fatalf("expected the winning fork to have rewritten bundle %s: %v", filename(0), err)
+	}
+	defer rewritten.Close()
+
+	data := make([]byte, 4096)
+	n, _ := rewritten.Read(data)
+	if !strings.Contains(string(data[:n]), "fork-") {
+		t.Fatalf("rewritten bundle %s = %q, want it to contain the winning fork's blocks", filename(0), data[:n])
+	}
+}
+
+// TestRollback_CommittedBundle_WithRecovery_ContentAddressedRequiresManifest
+// checks that recovery refuses to guess at a content-addressed bundle's
+// uuid suffix when no manifest is available to look it up in.
+func TestRollback_CommittedBundle_WithRecovery_ContentAddressedRequiresManifest(t *testing.T) {
+	store := newFakeStore()
+	w := newMergedBlocksWriter(store, fakeBlockWriterFactory{}, 0, 0, zap.NewNop(),
+		WithBundleSize(2), WithFirstStreamableBlock(0),
+		WithContentAddressedNaming(), WithOrphanedBundleRecovery())
+
+	for n := uint64(0); n <= 2; n++ {
+		if err := w.ProcessBlock(testBlock(n), nil); err != nil {
+			t.Fatalf("ProcessBlock(%d): %v", n, err)
+		}
+	}
+
+	err := w.ProcessBlock(testBlock(0), undoStep)
+	if err == nil || !strings.Contains(err.Error(), "without a manifest") {
+		t.Fatalf("undo without a manifest = %v, want an error about needing a manifest", err)
+	}
+}
+
+// TestRollback_CommittedBundle_WithRecovery_ContentAddressed checks that,
+// with a manifest available, recovery finds and deletes the uuid-suffixed
+// object rather than the plain range name.
+func TestRollback_CommittedBundle_WithRecovery_ContentAddressed(t *testing.T) {
+	store := newFakeStore()
+	w := newMergedBlocksWriter(store, fakeBlockWriterFactory{}, 0, 0, zap.NewNop(),
+		WithBundleSize(2), WithFirstStreamableBlock(0),
+		WithContentAddressedNaming(), WithBundleManifest(""), WithOrphanedBundleRecovery())
+
+	for n := uint64(0); n <= 2; n++ {
+		if err := w.ProcessBlock(testBlock(n), nil); err != nil {
+			t.Fatalf("ProcessBlock(%d): %v", n, err)
+		}
+	}
+
+	before := store.objectNames()
+	if len(before) == 0 {
+		t.Fatalf("expected the content-addressed bundle to have been written")
+	}
+
+	if err := w.ProcessBlock(testBlock(0), undoStep); err != nil {
+		t.Fatalf("undo of a content-addressed committed bundle with recovery enabled: %v", err)
+	}
+
+	for _, name := range store.objectNames() {
+		if strings.HasPrefix(name, filename(0)+"-") {
+			t.Fatalf("content-addressed bundle %s should have been deleted, still present", name)
+		}
+	}
+}
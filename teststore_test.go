@@ -0,0 +1,160 @@
+package sftools
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
+)
+
+// fakeStore is a minimal in-memory dstore.Store double shared by this
+// package's tests. It embeds a nil dstore.Store so it satisfies the full
+// interface without stubbing out every method; only the handful actually
+// exercised below are implemented.
+type fakeStore struct {
+	dstore.Store
+
+	mu    sync.Mutex
+	files map[string][]byte
+
+	// writeDelay, keyed by object name, makes WriteObject sleep before
+	// committing, so tests can fault-inject a slow upload.
+	writeDelay map[string]time.Duration
+
+	// failOn, keyed by object name, makes WriteObject return that error
+	// instead of storing the object.
+	failOn map[string]error
+
+	// failExistsOn, keyed by object name, makes FileExists return that
+	// error instead of reporting presence.
+	failExistsOn map[string]error
+
+	// writeOrder records the order in which WriteObject calls actually
+	// committed (as opposed to the order they were issued), so tests can
+	// assert on ordering guarantees made under concurrent uploads.
+	writeOrder []string
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		files:        make(map[string][]byte),
+		writeDelay:   make(map[string]time.Duration),
+		failOn:       make(map[string]error),
+		failExistsOn: make(map[string]error),
+	}
+}
+
+func (s *fakeStore) delayWrite(name string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeDelay[name] = d
+}
+
+func (s *fakeStore) failWrite(name string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failOn[name] = err
+}
+
+func (s *fakeStore) failExists(name string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failExistsOn[name] = err
+}
+
+func (s *fakeStore) WriteObject(ctx context.Context, base string, f io.Reader) error {
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delay := s.writeDelay[base]
+	failErr := s.failOn[base]
+	s.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	if failErr != nil {
+		return failErr
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[base] = data
+	s.writeOrder = append(s.writeOrder, base)
+	return nil
+}
+
+func (s *fakeStore) OpenObject(ctx context.Context, name string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	data, ok := s.files[name]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("object %s: not found", name)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *fakeStore) FileExists(ctx context.Context, base string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failExistsOn[base]; err != nil {
+		return false, err
+	}
+	_, ok := s.files[base]
+	return ok, nil
+}
+
+func (s *fakeStore) DeleteObject(ctx context.Context, base string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[base]; !ok {
+		return fmt.Errorf("object %s: not found", base)
+	}
+	delete(s.files, base)
+	return nil
+}
+
+func (s *fakeStore) objectNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	return names
+}
+
+// fakeBlockWriterFactory serializes blocks as "<number>:<id>\n" lines, just
+// enough structure for tests to reconstruct what was written without
+// depending on the real (and much heavier) block codecs.
+type fakeBlockWriterFactory struct{}
+
+func (fakeBlockWriterFactory) New(w io.Writer) (bstream.BlockWriter, error) {
+	return &fakeBlockWriter{w: w}, nil
+}
+
+type fakeBlockWriter struct {
+	w io.Writer
+}
+
+func (f *fakeBlockWriter) Write(blk *bstream.Block) error {
+	_, err := fmt.Fprintf(f.w, "%d:%s\n", blk.Number, blk.Id)
+	return err
+}
+
+func testBlock(number uint64) *bstream.Block {
+	return &bstream.Block{
+		Id:         fmt.Sprintf("%08x", number),
+		Number:     number,
+		PreviousId: fmt.Sprintf("%08x", number-1),
+	}
+}